@@ -3,273 +3,2109 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	argBind     string
-	argEndpoint string
-	argInterval time.Duration
-	argUserIds  []int
+	argBind        string
+	argEndpoint    string
+	argInterval    time.Duration
+	argMinInterval time.Duration
+	argWindow      time.Duration
+	argTimeout     time.Duration
+	argUserIds     []int
+
+	argCategories []Category
+	argTrace      bool
+	argRound      bool
+	argMaxBytes   int64
+	argConfig     bool
+	argExemplars  bool
+	argLabels     prometheus.Labels
+	argRequire    bool
+	argLayouts    []string
+	argScrape     bool
+	argAdminBind  string
+	argCurrency   string
+	argKeep       bool
+	argEmaAlpha   float64
+	argTLSMin     uint16
+	argUserLabel  string
+	argTxMinAbs   float64
+	argStrict     bool
+	argOmit       bool
+	argUsers      bool
+	argTokenFile  string
+	argToken      string
+	argBasicUser  string
+	argBasicPass  string
+	argRetryMax   time.Duration
+	argBackoff    int
+	argBackoffMax int
+	argZeroFill   bool
+	argLastError  bool
+	argSeries     bool
+	argSourceIP   net.IP
+	argCompute    bool
+	argFullTx     int
+	argTxTimes    bool
+	argProbe      bool
+	argAlign      bool
+	argStatus     bool
+	argAccept     string
+	argLowBalance *float64
+	argNative     bool
+	argNoRedirect bool
+	argStateFile  string
+	argOrder      string
+	argTxBuckets  []float64
+	argCheck      bool
+	argUserTiming bool
+
+	argPathSystem   string
+	argPathUserList string
+	argPathUser     string
+
+	argTransferPatterns []TransferPattern
+	argTransferHint     *regexp.Regexp
+
+	// raw flag values, validated by configure
+	rawInterval, rawSourceAddr, rawTLSMin, rawLayouts, rawHint string
+	fromPatterns, toPatterns                                   []*regexp.Regexp
 )
 
-func init() {
-	flag.StringVar(&argBind, "bind", "localhost:8080", "address and port to bind")
-	flag.StringVar(&argEndpoint, "api", "http://localhost:8080", "strichliste api")
+func init() {
+	registerFlags(flag.CommandLine)
+}
+
+func registerFlags(fs *flag.FlagSet) {
+	argCategories, argLowBalance, argTxBuckets, argLabels = nil, nil, nil, nil
+	fromPatterns, toPatterns = nil, nil
+
+	fs.StringVar(&argBind, "bind", "localhost:8080", "address and port to bind")
+	fs.StringVar(&argAdminBind, "admin-bind", "", "address and port to bind pprof, /config, /scrape and /users to instead")
+	fs.StringVar(&argEndpoint, "api", "http://localhost:8080", "strichliste api")
+	fs.StringVar(&argPathSystem, "path-system", "/metrics", "path of the system metrics below -api")
+	fs.StringVar(&argPathUserList, "path-userlist", "/user", "path of the user list below -api")
+	fs.StringVar(&argPathUser, "path-user", "/user/{id}", "path of a single user below -api, {id} is replaced by the user id")
+
+	fs.StringVar(&rawInterval, "interval", "5m", "interval for scraping upstream, 0 to scrape on each request")
+	fs.DurationVar(&argTimeout, "timeout", 30*time.Second, "timeout of a single upstream request, 0 for none")
+	fs.DurationVar(&argMinInterval, "min-interval", 10*time.Second, "shortest -interval allowed, shorter ones are raised to it, with -interval 0 the shortest time between scrapes")
+	fs.DurationVar(&argWindow, "window", 0, "how long a TX counts as recent, defaults to -interval, or 5m with -interval 0")
+	fs.BoolVar(&argAlign, "align", false, "align scrape cycles to multiples of the interval on the wall clock")
+	fs.BoolVar(&argNoRedirect, "no-follow-redirects", false, "fail on upstream redirects instead of following them")
+	fs.StringVar(&argOrder, "scrape-order", "given", "order users are scraped in (given, asc, desc, random), given is the command line or user list order")
+	fs.BoolVar(&argTrace, "trace", false, "log connection timings of upstream requests")
+	fs.StringVar(&argUserLabel, "user-label-name", "user", "name of the label carrying the user name")
+	fs.StringVar(&argAccept, "accept", "application/json", "Accept header sent with upstream requests, empty to omit it")
+	fs.StringVar(&argStateFile, "state-file", "", "file the highest seen TX ids are kept in across restarts")
+	fs.StringVar(&argTokenFile, "token-file", "", "file containing a bearer token for upstream requests, defaults to $STRICHLISTE_TOKEN")
+	fs.StringVar(&argCurrency, "currency", "", "currency unit added as label to balance metrics")
+	fs.Float64Var(&argEmaAlpha, "ema-alpha", 0.3, "smoothing factor of the scrape duration moving average, in (0, 1]")
+	fs.Float64Var(&argTxMinAbs, "tx-min-abs", 0, "don't emit tx series for TXs with a smaller absolute value")
+	fs.BoolVar(&argStrict, "strict-json", false, "fail on unknown fields and warn about trailing data in upstream responses")
+	fs.BoolVar(&argOmit, "tx-omit-parties", false, "drop the from and to labels of the tx metric")
+	fs.DurationVar(&argRetryMax, "retry-after-max", 30*time.Second, "longest Retry-After to wait for before retrying once, 0 to never retry")
+	fs.IntVar(&argBackoff, "backoff-after", 3, "consecutive failures before a user is skipped for some cycles, 0 to disable")
+	fs.IntVar(&argBackoffMax, "backoff-max", 32, "maximum number of cycles a failing user is skipped for")
+	fs.BoolVar(&argUserTiming, "user-scrape-duration-by-user", false, "label user_scrape_duration_seconds by user, failures of users that never scraped go unobserved")
+	fs.BoolVar(&argZeroFill, "zero-fill", false, "emit user_recent_tx_count for users without recent TXs too")
+	fs.BoolVar(&argLastError, "expose-last-error", false, "expose the last scrape error as label of last_scrape_error")
+	fs.BoolVar(&argSeries, "series-gauge", false, "count the series exposed after each cycle into exporter_series, gathers the registry")
+	fs.BoolVar(&argCompute, "compute-system", false, "also derive system balance, average and user count from the scraped users")
+	fs.IntVar(&argFullTx, "full-transactions", 0, "also fetch this many recent TXs per user from the transaction endpoint, 0 to disable")
+	fs.BoolVar(&argTxTimes, "use-api-timestamps", false, "timestamp tx samples with the time of their TX instead of the scrape")
+	fs.BoolVar(&argProbe, "comment-cardinality-probe", false, "count distinct TX comments per cycle into distinct_comments")
+	fs.BoolVar(&argRound, "round-balances", false, "round balances to two decimals")
+	fs.Int64Var(&argMaxBytes, "max-response-bytes", 16<<20, "maximum size of upstream responses, 0 for unlimited")
+	fs.BoolVar(&argCheck, "check-config", false, "validate the flags, print the effective configuration and exit")
+	fs.BoolVar(&argConfig, "config-endpoint", false, "serve the effective configuration on /config")
+	fs.BoolVar(&argNative, "native-histograms", false, "also expose histograms as native histograms, needs the protobuf exposition format")
+	fs.BoolVar(&argExemplars, "exemplars", false, "attach TX ids as OpenMetrics exemplars to TX counters")
+	fs.BoolVar(&argRequire, "require-users", false, "exit if the first scrape cycle resolves no users")
+	fs.BoolVar(&argUsers, "users-endpoint", false, "serve the currently tracked users on /users")
+	fs.BoolVar(&argStatus, "status-page", false, "serve a short status summary on /")
+	fs.BoolVar(&argScrape, "scrape-endpoint", false, "trigger a scrape cycle on POST /scrape")
+	fs.Func("category", "map TX comments matching regex to category as regex=category (repeatable)", func(raw string) error {
+		i := strings.LastIndex(raw, "=")
+		if i < 0 {
+			return fmt.Errorf("%s isn't regex=category", raw)
+		}
+		pattern, err := regexp.Compile(raw[:i])
+		if err != nil {
+			return err
+		}
+		argCategories = append(argCategories, Category{Pattern: pattern, Name: raw[i+1:]})
+		return nil
+	})
+	fs.Func("low-balance-threshold", "expose user_below_threshold for users with a balance below this", func(raw string) error {
+		threshold, err := strconv.ParseFloat(raw, 64)
+		argLowBalance = &threshold
+		return err
+	})
+	fs.Func("tx-buckets", "count new TXs per user into tx_bucket_total by absolute value, with these comma-separated ascending upper bounds", func(raw string) error {
+		for _, boundRaw := range strings.Split(raw, ",") {
+			bound, err := strconv.ParseFloat(boundRaw, 64)
+			if err != nil {
+				return err
+			}
+			if n := len(argTxBuckets); n > 0 && bound <= argTxBuckets[n-1] {
+				return fmt.Errorf("%s isn't ascending", raw)
+			}
+			argTxBuckets = append(argTxBuckets, bound)
+		}
+		return nil
+	})
+	fs.Func("const-labels", "constant labels added to every metric as k=v,k2=v2", func(raw string) error {
+		var err error
+		argLabels, err = parseLabels(raw)
+		return err
+	})
+
+	fs.StringVar(&rawSourceAddr, "source-address", "", "local IP address for upstream connections")
+
+	fs.StringVar(&rawTLSMin, "tls-min-version", "1.2", "minimum TLS version for upstream connections (1.0, 1.1, 1.2, 1.3)")
+
+	fs.StringVar(&rawLayouts, "time-layouts", "2006-01-02 15:04:05", "comma-separated Go time layouts tried for TX timestamps")
+
+	fs.BoolVar(&argKeep, "keep-comment", false, "keep TX comments that were parsed as a transfer")
+
+	fs.StringVar(&rawHint, "transfer-hint", `(?i)^(from|to)\b`, "regex for TX comments that look like a transfer")
+
+	fs.Func("from-pattern", "regex extracting the sender from TX comments (repeatable, paired with -to-pattern)", func(raw string) error {
+		pattern, err := compileTransferPattern(raw)
+		fromPatterns = append(fromPatterns, pattern)
+		return err
+	})
+	fs.Func("to-pattern", "regex extracting the recipient from TX comments (repeatable, paired with -from-pattern)", func(raw string) error {
+		pattern, err := compileTransferPattern(raw)
+		toPatterns = append(toPatterns, pattern)
+		return err
+	})
+}
+
+// configure validates the parsed flags and derives the remaining arg*
+// values from them. args are the positional user ids.
+func configure(args []string) error {
+	argTransferPatterns, argLayouts, argUserIds = nil, nil, nil
+
+	if len(fromPatterns) != len(toPatterns) {
+		return errors.New("-from-pattern and -to-pattern must be given the same number of times")
+	}
+	if len(fromPatterns) == 0 {
+		fromPatterns = append(fromPatterns, regexp.MustCompile("^from (.*)$"))
+		toPatterns = append(toPatterns, regexp.MustCompile("^to (.*)$"))
+	}
+	for i := range fromPatterns {
+		argTransferPatterns = append(argTransferPatterns, TransferPattern{From: fromPatterns[i], To: toPatterns[i]})
+	}
+
+	if !strings.Contains(argPathUser, "{id}") {
+		return errors.New("-path-user must contain {id}")
+	}
+
+	var err error
+	if argTransferHint, err = regexp.Compile(rawHint); err != nil {
+		return err
+	}
+
+	for _, bind := range []string{argBind, argAdminBind} {
+		if bind == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(bind); err != nil {
+			return fmt.Errorf("%s isn't host:port, IPv6 addresses need brackets as in [::1]:8080", bind)
+		}
+	}
+
+	argSourceIP = nil
+	if rawSourceAddr != "" {
+		if argSourceIP = net.ParseIP(rawSourceAddr); argSourceIP == nil {
+			return fmt.Errorf("%s isn't an IP address", rawSourceAddr)
+		}
+	}
+
+	if argTokenFile != "" {
+		token, err := os.ReadFile(argTokenFile)
+		if err != nil {
+			return err
+		}
+		argToken = strings.TrimSpace(string(token))
+	} else {
+		argToken = strings.TrimSpace(os.Getenv("STRICHLISTE_TOKEN"))
+	}
+
+	// basic auth credentials override a password in -api, so it never has
+	// to appear on the command line either
+	argBasicUser, argBasicPass = os.Getenv("STRICHLISTE_USER"), os.Getenv("STRICHLISTE_PASSWORD")
+	if argToken != "" && (argBasicUser != "" || argBasicPass != "") {
+		return errors.New("use either a bearer token or STRICHLISTE_USER and STRICHLISTE_PASSWORD")
+	}
+
+	if err := checkLabelName(argUserLabel); err != nil {
+		return fmt.Errorf("-user-label-name: %w", err)
+	}
+
+	for name := range argLabels {
+		if err := checkLabelName(name); err != nil {
+			return fmt.Errorf("-const-labels: %w", err)
+		}
+		if name == argUserLabel {
+			return fmt.Errorf("-const-labels: %s is already the user label", name)
+		}
+	}
+
+	var ok bool
+	if argTLSMin, ok = tlsVersions[rawTLSMin]; !ok {
+		return fmt.Errorf("%s isn't a TLS version", rawTLSMin)
+	}
+
+	switch argOrder {
+	case "given", "asc", "desc", "random":
+	default:
+		return fmt.Errorf("%s isn't a scrape order", argOrder)
+	}
+
+	if argTimeout < 0 {
+		return errors.New("-timeout must not be negative")
+	}
+
+	if argFullTx < 0 {
+		return errors.New("-full-transactions must not be negative")
+	}
+
+	if argBackoff < 0 || argBackoffMax < 1 {
+		return errors.New("-backoff-after must not be negative and -backoff-max must be positive")
+	}
+
+	if argEmaAlpha <= 0 || argEmaAlpha > 1 {
+		return errors.New("-ema-alpha must be in (0, 1]")
+	}
+
+	for _, layout := range strings.Split(rawLayouts, ",") {
+		if err := checkTimeLayout(layout); err != nil {
+			return err
+		}
+		argLayouts = append(argLayouts, layout)
+	}
+
+	for _, idRaw := range args {
+		id, err := strconv.Atoi(idRaw)
+		if err != nil {
+			return fmt.Errorf("%s isn't user id", idRaw)
+		}
+		argUserIds = append(argUserIds, id)
+	}
+
+	if argInterval, err = time.ParseDuration(rawInterval); err != nil {
+		return err
+	}
+	if argInterval > 0 && argInterval < argMinInterval {
+		log.Printf("warning: -interval %s is below -min-interval, using %s\n", argInterval, argMinInterval)
+		argInterval = argMinInterval
+	}
+
+	if argWindow < 0 {
+		return errors.New("-window must not be negative")
+	}
+	if argWindow == 0 {
+		argWindow = argInterval
+	}
+	if argWindow == 0 {
+		argWindow = 5 * time.Minute
+	}
+	return nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: argTLSMin}
+
+	if argSourceIP != nil {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: &net.TCPAddr{IP: argSourceIP},
+		}
+		transport.DialContext = dialer.DialContext
+	}
+	return transport
+}
+
+var labelNamePattern = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// label names the metrics carry themselves, including the ones of
+// histograms and summaries
+var fixedLabels = []string{
+	"id", "from", "to", "sign", "endpoint", "code", "category", "bucket",
+	"mode", "scrape_all", "error", "currency", "le", "quantile",
+}
+
+func checkLabelName(name string) error {
+	if !labelNamePattern.MatchString(name) {
+		return fmt.Errorf("%s isn't a valid label name", name)
+	}
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("%s is reserved, label names must not start with __", name)
+	}
+	for _, fixed := range fixedLabels {
+		if name == fixed {
+			return fmt.Errorf("%s is already a label of some metrics", name)
+		}
+	}
+	return nil
+}
+
+func parseLabels(raw string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	for _, pair := range strings.Split(raw, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || !labelNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("%s isn't name=value", pair)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+func checkTimeLayout(layout string) error {
+	// any time but the reference time itself, which formats to the layout
+	sample := time.Date(1999, time.December, 31, 23, 58, 59, 0, time.UTC)
+
+	formatted := sample.Format(layout)
+	if formatted == layout {
+		return fmt.Errorf("time layout %q contains no reference time elements", layout)
+	}
+	if _, err := time.Parse(layout, formatted); err != nil {
+		return fmt.Errorf("time layout %q: %w", layout, err)
+	}
+	return nil
+}
+
+func compileTransferPattern(raw string) (*regexp.Regexp, error) {
+	pattern, err := regexp.Compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	if pattern.NumSubexp() < 1 {
+		return nil, fmt.Errorf("%s has no capture group", raw)
+	}
+	return pattern, nil
+}
+
+type TransferPattern struct {
+	From *regexp.Regexp
+	To   *regexp.Regexp
+}
+
+type Category struct {
+	Pattern *regexp.Regexp
+	Name    string
+}
+
+type Strichliste struct {
+	Client      http.Client
+	ApiEndpoint string
+
+	ScrapeInterval time.Duration
+	MinInterval    time.Duration
+	Window         time.Duration
+	ScrapeAll      bool
+	Categories     []Category
+	Transfers      []TransferPattern
+	KeepComment    bool
+	TransferHint   *regexp.Regexp
+	Trace          bool
+	RoundBalances  bool
+	MaxBytes       int64
+	StrictJSON     bool
+	Token          string
+	BasicUser      string
+	BasicPassword  string
+	RetryAfterMax  time.Duration
+	BackoffAfter   int
+	BackoffMax     int
+	Exemplars      bool
+	RequireUsers   bool
+	EmaAlpha       float64
+	TxMinAbs       float64
+	OmitParties    bool
+	ZeroFill       bool
+	ExposeError    bool
+	CountSeries    bool
+	ComputeSystem  bool
+	FullTx         int
+	TxTimestamps   bool
+	CommentProbe   bool
+	Accept         string
+	LowBalance     *float64
+	ScrapeOrder    string
+	TxBuckets      []float64
+	TimingByUser   bool
+	PathSystem     string
+	PathUserList   string
+	PathUser       string
+	TimeLayouts    []string
+
+	UserIDs []int
+
+	// gathered for exporter_series
+	registry *prometheus.Registry
+
+	// serializes scrape cycles
+	cycle sync.Mutex
+
+	// keeps gathering from observing a partially updated cycle
+	mu sync.RWMutex
+
+	// set while a background scrape cycle is running
+	running atomic.Bool
+
+	// shuffles users for -scrape-order random, only used by cycles
+	rand *rand.Rand
+
+	// moving average of the scrape cycle duration in seconds
+	durationEMA float64
+
+	// set once upstream answered /metrics with 404
+	systemMissing bool
+
+	// cycles run and cycles with failures, behind the failure ratio
+	cycles, failures int
+
+	// result of the previous scrape cycle
+	last ScrapeResult
+
+	// highest TX id seen per user id
+	TxHighWater map[int]int
+
+	// name and time of the last successful scrape per user id
+	UserNames   map[int]string
+	LastScraped map[int]time.Time
+
+	// balance per user id as of the last cycle
+	PrevBalance map[int]float64
+
+	// consecutive failures per user id
+	Backoffs map[int]*Backoff
+
+	Metrics struct {
+		ScrapeCycles   prometheus.Counter
+		ScrapeFailures prometheus.Counter
+		ScrapeOverlaps prometheus.Counter
+		ScrapeEMA      prometheus.Gauge
+		ScrapeRatio    prometheus.Gauge
+		LastError      *prometheus.GaugeVec
+		ExporterSeries prometheus.Gauge
+		ModeInfo       *prometheus.GaugeVec
+
+		SystemTxCount    prometheus.Gauge
+		SystemUserCount  prometheus.Gauge
+		SystemBalance    prometheus.Gauge
+		SystemBalanceAvg prometheus.Gauge
+		SystemAvailable  prometheus.Gauge
+		ActiveUsers      prometheus.Gauge
+		BalanceMin       prometheus.Gauge
+		BalanceMax       prometheus.Gauge
+		UsersInDebt      prometheus.Gauge
+		UsersInCredit    prometheus.Gauge
+		TotalDebt        prometheus.Gauge
+		AvgTxPerUser     prometheus.Gauge
+
+		ComputedBalance    prometheus.Gauge
+		ComputedBalanceAvg prometheus.Gauge
+		ComputedUserCount  prometheus.Gauge
+		BalanceDiscrepancy prometheus.Gauge
+
+		UserTxCount      *prometheus.GaugeVec
+		UserBalance      *prometheus.GaugeVec
+		UserWeight       *prometheus.GaugeVec
+		UserDays         *prometheus.GaugeVec
+		UserTxRate       *prometheus.GaugeVec
+		UserAge          *prometheus.GaugeVec
+		UserTxSign       *prometheus.GaugeVec
+		UserTxParsed     *prometheus.GaugeVec
+		UserBalanceDelta *prometheus.GaugeVec
+		UserActivity     *prometheus.GaugeVec
+		UserParseErrors  *prometheus.GaugeVec
+		UserBackoff      *prometheus.GaugeVec
+		UserRecentTx     *prometheus.GaugeVec
+		UserMaxTx        *prometheus.GaugeVec
+		UserLowBalance   *prometheus.GaugeVec
+		UserActive       *prometheus.GaugeVec
+		UserDuration     *prometheus.HistogramVec
+		UserDeltas       *prometheus.GaugeVec
+		UserDeltasAt     *TimestampedGaugeVec
+
+		HttpRequests  *prometheus.CounterVec
+		HttpResponses *prometheus.CounterVec
+		HttpInFlight  prometheus.Gauge
+		HttpDecode    *prometheus.HistogramVec
+		HttpBytes     *prometheus.CounterVec
+
+		TxCategories   *prometheus.CounterVec
+		TxBuckets      *prometheus.CounterVec
+		TxNew          prometheus.Counter
+		TxValueSum     prometheus.Counter
+		TxUnattributed prometheus.Counter
+		TxTransfers    prometheus.Counter
+		TxSeries       prometheus.Gauge
+		Comments       prometheus.Gauge
+
+		NameCollisions prometheus.Gauge
+		StaleUsers     prometheus.Gauge
+		UserListUp     prometheus.Gauge
+		UserListSize   prometheus.Gauge
+		TrackedTxIDs   prometheus.Gauge
+	}
+}
+
+type Transaction struct {
+	Id      int    `json:"id"`
+	WhenRaw string `json:"createDate"`
+	When    time.Time
+	Delta   float64 `json:"-"`
+	From    *string
+	To      *string
+	Comment *string `json:"comment"`
+
+	// looks like a transfer but matched no pattern
+	Unattributed bool
+
+	// only sent by newer API versions
+	Sender    *Party `json:"sender"`
+	Recipient *Party `json:"recipient"`
+
+	// API versions differ in where they put the TX value, see value
+	Value   *Money          `json:"value"`
+	Amount  *Money          `json:"amount"`
+	Article json.RawMessage `json:"article"`
+
+	// unused, declared for -strict-json
+	UserId int `json:"userId"`
+}
+
+// value returns the TX value from value, amount or article.amount, whichever
+// comes first. v1 sends value and no article, v2 sends amount, with the
+// article only as a reference, so article.amount is a last resort for
+// builds that only nest it.
+func (tx *Transaction) value() (float64, bool) {
+	switch {
+	case tx.Value != nil:
+		return float64(*tx.Value), true
+	case tx.Amount != nil:
+		return float64(*tx.Amount), true
+	}
+
+	// the article carries more fields than we care about, so it's never
+	// decoded strictly
+	var article struct {
+		Amount *Money `json:"amount"`
+	}
+	if json.Unmarshal(tx.Article, &article) != nil || article.Amount == nil {
+		return 0, false
+	}
+	return float64(*article.Amount), true
+}
+
+type Party struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type User struct {
+	Id       int            `json:"id"`
+	Name     string         `json:"name"`
+	Weight   float64        `json:"weightedCountOfPurchases"`
+	Days     int            `json:"activeDays"`
+	Balance  Money          `json:"balance"`
+	TxCount  int            `json:"countOfTransactions"`
+	TxRecent []*Transaction `json:"transactions"`
+
+	// only sent by some API versions, users count as active without it
+	Active *bool `json:"isActive"`
+
+	// unused, declared for -strict-json
+	LastTx *string `json:"lastTransaction"`
+
+	// TXs dropped from TxRecent because they couldn't be parsed
+	TxParseErrors int `json:"-"`
+}
+
+type System struct {
+	TxCount    int   `json:"countTransactions"`
+	AvgBalance Money `json:"avgBalance"`
+	UserCount  int   `json:"countUsers"`
+	Balance    Money `json:"overallBalance"`
+
+	// unused, declared for -strict-json
+	Days json.RawMessage `json:"days"`
+}
+
+// Money is a monetary value that upstream may send as a number or as a
+// numeric string.
+type Money float64
+
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var value float64
+	if len(data) > 0 && data[0] == '"' {
+		var raw string
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return err
+		}
+		var err error
+		// ParseFloat takes NaN and Inf, which JSON numbers can't be
+		value, err = strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("%q isn't a monetary value", raw)
+		}
+	} else if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	*m = Money(value)
+	return nil
+}
+
+type Config struct {
+	Bind             string            `json:"bind"`
+	AdminBind        string            `json:"admin_bind"`
+	ApiEndpoint      string            `json:"api"`
+	PathSystem       string            `json:"path_system"`
+	PathUserList     string            `json:"path_userlist"`
+	PathUser         string            `json:"path_user"`
+	TokenFile        string            `json:"token_file"`
+	BasicUser        string            `json:"basic_user,omitempty"`
+	StateFile        string            `json:"state_file"`
+	Accept           string            `json:"accept"`
+	NoFollowRedirect bool              `json:"no_follow_redirects"`
+	Interval         string            `json:"interval"`
+	MinInterval      string            `json:"min_interval"`
+	Window           string            `json:"window"`
+	Align            bool              `json:"align"`
+	Timeout          string            `json:"timeout"`
+	RetryAfterMax    string            `json:"retry_after_max"`
+	BackoffAfter     int               `json:"backoff_after"`
+	BackoffMax       int               `json:"backoff_max"`
+	TLSMinVersion    string            `json:"tls_min_version"`
+	SourceAddress    string            `json:"source_address"`
+	ScrapeAll        bool              `json:"scrape_all"`
+	ScrapeOrder      string            `json:"scrape_order"`
+	UserIDs          []int             `json:"user_ids"`
+	Categories       map[string]string `json:"categories"`
+	Transfers        []Transfer        `json:"transfers"`
+	KeepComment      bool              `json:"keep_comment"`
+	TransferHint     string            `json:"transfer_hint"`
+	Trace            bool              `json:"trace"`
+	RoundBalances    bool              `json:"round_balances"`
+	MaxResponseBytes int64             `json:"max_response_bytes"`
+	StrictJSON       bool              `json:"strict_json"`
+	Exemplars        bool              `json:"exemplars"`
+	NativeHistograms bool              `json:"native_histograms"`
+	ConstLabels      prometheus.Labels `json:"const_labels"`
+	Currency         string            `json:"currency"`
+	UserLabel        string            `json:"user_label_name"`
+	TxMinAbs         float64           `json:"tx_min_abs"`
+	TxOmitParties    bool              `json:"tx_omit_parties"`
+	TxBuckets        []float64         `json:"tx_buckets"`
+	ZeroFill         bool              `json:"zero_fill"`
+	DurationByUser   bool              `json:"user_scrape_duration_by_user"`
+	LowBalance       *float64          `json:"low_balance_threshold"`
+	SeriesGauge      bool              `json:"series_gauge"`
+	ComputeSystem    bool              `json:"compute_system"`
+	FullTransactions int               `json:"full_transactions"`
+	UseApiTimestamps bool              `json:"use_api_timestamps"`
+	CommentProbe     bool              `json:"comment_cardinality_probe"`
+	RequireUsers     bool              `json:"require_users"`
+	TimeLayouts      []string          `json:"time_layouts"`
+}
+
+type Transfer struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (s *Strichliste) config() Config {
+	endpoint := s.ApiEndpoint
+	if u, err := url.Parse(s.ApiEndpoint); err == nil {
+		endpoint = u.Redacted()
+	}
+
+	categories := map[string]string{}
+	for _, category := range s.Categories {
+		categories[category.Pattern.String()] = category.Name
+	}
+
+	tlsMin := ""
+	for name, version := range tlsVersions {
+		if version == argTLSMin {
+			tlsMin = name
+		}
+	}
+
+	sourceAddress := ""
+	if argSourceIP != nil {
+		sourceAddress = argSourceIP.String()
+	}
+
+	transfers := []Transfer{}
+	for _, pattern := range s.Transfers {
+		transfers = append(transfers, Transfer{From: pattern.From.String(), To: pattern.To.String()})
+	}
+
+	return Config{
+		Bind:             argBind,
+		AdminBind:        argAdminBind,
+		ApiEndpoint:      endpoint,
+		PathSystem:       s.PathSystem,
+		PathUserList:     s.PathUserList,
+		PathUser:         s.PathUser,
+		TokenFile:        argTokenFile,
+		BasicUser:        s.BasicUser,
+		StateFile:        argStateFile,
+		Accept:           s.Accept,
+		NoFollowRedirect: argNoRedirect,
+		Interval:         s.ScrapeInterval.String(),
+		MinInterval:      s.MinInterval.String(),
+		Window:           s.Window.String(),
+		Align:            argAlign,
+		Timeout:          s.Client.Timeout.String(),
+		RetryAfterMax:    s.RetryAfterMax.String(),
+		BackoffAfter:     s.BackoffAfter,
+		BackoffMax:       s.BackoffMax,
+		TLSMinVersion:    tlsMin,
+		SourceAddress:    sourceAddress,
+		ScrapeAll:        s.ScrapeAll,
+		ScrapeOrder:      s.ScrapeOrder,
+		UserIDs:          argUserIds,
+		Categories:       categories,
+		Transfers:        transfers,
+		KeepComment:      s.KeepComment,
+		TransferHint:     s.TransferHint.String(),
+		Trace:            s.Trace,
+		RoundBalances:    s.RoundBalances,
+		MaxResponseBytes: s.MaxBytes,
+		StrictJSON:       s.StrictJSON,
+		Exemplars:        s.Exemplars,
+		NativeHistograms: argNative,
+		ConstLabels:      argLabels,
+		Currency:         argCurrency,
+		UserLabel:        argUserLabel,
+		TxMinAbs:         s.TxMinAbs,
+		TxOmitParties:    s.OmitParties,
+		TxBuckets:        s.TxBuckets,
+		ZeroFill:         s.ZeroFill,
+		DurationByUser:   s.TimingByUser,
+		LowBalance:       s.LowBalance,
+		SeriesGauge:      s.CountSeries,
+		ComputeSystem:    s.ComputeSystem,
+		FullTransactions: s.FullTx,
+		UseApiTimestamps: s.TxTimestamps,
+		CommentProbe:     s.CommentProbe,
+		RequireUsers:     argRequire,
+		TimeLayouts:      s.TimeLayouts,
+	}
+}
+
+// checkConfig writes the effective configuration to w for -check-config.
+// Registering into a throwaway registry catches what configure can't, e.g.
+// label names clashing within a metric.
+func (s *Strichliste) checkConfig(w io.Writer) error {
+	if err := s.initMetrics(prometheus.NewRegistry()); err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(s.config())
+}
+
+func (s *Strichliste) serveConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.config()); err != nil {
+		log.Println("error: could not encode config:", err)
+	}
+}
+
+type TrackedUser struct {
+	Id   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+func (s *Strichliste) serveUsers(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	users := []TrackedUser{}
+	for _, uid := range s.UserIDs {
+		users = append(users, TrackedUser{Id: uid, Name: s.UserNames[uid]})
+	}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(users); err != nil {
+		log.Println("error: could not encode users:", err)
+	}
+}
+
+type State struct {
+	TxHighWater map[int]int `json:"tx_high_water"`
+}
+
+// loadState restores the highest seen TX ids. A missing or unreadable
+// state file just means starting fresh.
+func (s *Strichliste) loadState(path string) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Println("warning: ignoring state file:", err)
+		return
+	}
+
+	var state State
+	if err := json.Unmarshal(raw, &state); err != nil {
+		log.Printf("warning: ignoring state file %s: %v\n", path, err)
+		return
+	}
+	for uid, id := range state.TxHighWater {
+		s.TxHighWater[uid] = id
+	}
+}
+
+// saveState writes the highest seen TX ids to a temporary file next to
+// path and renames it over path, so a crash never leaves a partial file.
+func (s *Strichliste) saveState(path string) error {
+	s.mu.Lock()
+	raw, err := json.Marshal(State{TxHighWater: s.TxHighWater})
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *Strichliste) get(endpoint, url string, v interface{}) error {
+	s.Metrics.HttpInFlight.Inc()
+	defer s.Metrics.HttpInFlight.Dec()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	// from here on url ends up in errors and logs, which must not carry a
+	// password from -api
+	url = req.URL.Redacted()
+	if s.Accept != "" {
+		req.Header.Set("Accept", s.Accept)
+	}
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	if s.BasicUser != "" || s.BasicPassword != "" {
+		req.SetBasicAuth(s.BasicUser, s.BasicPassword)
+	}
+	if s.Trace {
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), traceRequest(url)))
+	}
+
+	var resp *http.Response
+	for retried := false; ; retried = true {
+		s.Metrics.HttpRequests.WithLabelValues(endpoint).Inc()
+		if resp, err = s.Client.Do(req); err != nil {
+			return err
+		}
+		s.Metrics.HttpResponses.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+
+		wait, ok := retryAfter(resp)
+		if !ok || retried || s.RetryAfterMax <= 0 || wait > s.RetryAfterMax {
+			break
+		}
+		resp.Body.Close()
+		log.Printf("warning: %s: got status %d, retrying in %s\n", url, resp.StatusCode, wait)
+		time.Sleep(wait)
+	}
+	defer resp.Body.Close()
+
+	// only seen with -no-follow-redirects, usually a login page
+	if location := resp.Header.Get("Location"); resp.StatusCode/100 == 3 && location != "" {
+		return fmt.Errorf("%w, redirected to %s", &StatusError{Code: resp.StatusCode, URL: url}, location)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Code: resp.StatusCode, URL: url}
+	}
+
+	// The transport requests gzip and decompresses transparently as long
+	// as Accept-Encoding isn't set manually. Some proxies compress anyway,
+	// so handle that here too.
+	var body io.Reader = &countingReader{r: resp.Body, counter: s.Metrics.HttpBytes.WithLabelValues(endpoint)}
+	if !resp.Uncompressed && resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	if s.MaxBytes > 0 {
+		body = &limitedReader{r: body, n: s.MaxBytes}
+	}
+
+	// read the whole body first so the decode duration excludes the
+	// network
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	// with -strict-json, the decode error names the first unknown field
+	start := time.Now()
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if s.StrictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	err = decoder.Decode(v)
+	s.Metrics.HttpDecode.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+
+	// Decode stops after the first JSON document, anything but whitespace
+	// after it hints at a proxy concatenating responses
+	if s.StrictJSON {
+		var extra json.RawMessage
+		if err := decoder.Decode(&extra); err != io.EOF {
+			log.Printf("warning: %s: trailing data after JSON document\n", url)
+		}
+	}
+	return nil
+}
+
+// retryAfter returns how long a 429 or 503 response asks us to wait.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	header := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(header); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return time.Duration(math.Max(0, float64(time.Until(t)))), true
+	}
+	return 0, false
+}
+
+type StatusError struct {
+	Code int
+	URL  string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: unexpected status %d", e.URL, e.Code)
+}
+
+var errResponseTooLarge = errors.New("response exceeds size limit")
+
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// a body of exactly the limit is fine
+		if n, err := l.r.Read(make([]byte, 1)); n == 0 && err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, errResponseTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+type countingReader struct {
+	r       io.Reader
+	counter prometheus.Counter
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+func traceRequest(url string) *httptrace.ClientTrace {
+	start := time.Now()
+	var dnsStart, connectStart, tlsStart time.Time
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			log.Printf("debug: %s: dns lookup took %s (err: %v)\n", url, time.Since(dnsStart), info.Err)
+		},
+		ConnectStart: func(network, addr string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			log.Printf("debug: %s: connect to %s took %s (err: %v)\n", url, addr, time.Since(connectStart), err)
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			log.Printf("debug: %s: tls handshake took %s (err: %v)\n", url, time.Since(tlsStart), err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			log.Printf("debug: %s: got connection after %s (reused: %t)\n", url, time.Since(start), info.Reused)
+		},
+		GotFirstResponseByte: func() {
+			log.Printf("debug: %s: first byte after %s\n", url, time.Since(start))
+		},
+	}
+}
+
+func (s *Strichliste) fetchSystem() (*System, error) {
+	url := s.ApiEndpoint + s.PathSystem
+
+	var system System
+	if err := s.get("system", url, &system); err != nil {
+		return nil, fmt.Errorf("fetch system metrics: %w", err)
+	}
+	return &system, nil
+}
+
+func parseStrichlisteTime(raw string, layouts []string) (*time.Time, error) {
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		if t, err = time.Parse(layout, raw); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, err
+}
+
+func (s *Strichliste) fetchUser(uid int) (*User, error) {
+	url := s.ApiEndpoint + strings.ReplaceAll(s.PathUser, "{id}", strconv.Itoa(uid))
+
+	var user User
+	if err := s.get("user", url, &user); err != nil {
+		return nil, fmt.Errorf("fetch user %d: %w", uid, err)
+	}
+	user.Id = uid
+
+	if s.FullTx > 0 {
+		txs, err := s.fetchUserTransactions(uid)
+		if err != nil {
+			log.Printf("warning: using embedded TXs of user %d only: %v\n", uid, err)
+		}
+		user.TxRecent = mergeTransactions(user.TxRecent, txs)
+	}
+
+	// transactions may be null or absent, in which case only the scalar
+	// user metrics are set
+	txs := user.TxRecent[:0]
+	for _, tx := range user.TxRecent {
+		if tx == nil {
+			continue
+		}
+
+		t, err := parseStrichlisteTime(tx.WhenRaw, s.TimeLayouts)
+		if err != nil {
+			log.Printf("warning: skipping TX %d of user %d: %v\n", tx.Id, uid, err)
+			user.TxParseErrors++
+			continue
+		}
+		tx.When = *t
+		txs = append(txs, tx)
+
+		var ok bool
+		if tx.Delta, ok = tx.value(); !ok && tx.Id > s.TxHighWater[uid] {
+			log.Printf("warning: TX %d of user %d has no value, amount or article amount\n", tx.Id, uid)
+		}
+
+		switch {
+		case tx.Sender != nil && tx.Sender.Id != uid:
+			tx.From = &tx.Sender.Name
+		case tx.Recipient != nil && tx.Recipient.Id != uid:
+			tx.To = &tx.Recipient.Name
+		case tx.Comment != nil:
+			s.attribute(tx)
+		}
+	}
+	user.TxRecent = txs
+
+	return &user, nil
+}
+
+// fetchUserTransactions fetches the most recent page of a user's TXs, which
+// may reach further back than the TXs embedded in the user.
+func (s *Strichliste) fetchUserTransactions(uid int) ([]*Transaction, error) {
+	url := s.ApiEndpoint + strings.ReplaceAll(s.PathUser, "{id}", strconv.Itoa(uid)) +
+		fmt.Sprintf("/transaction?limit=%d", s.FullTx)
+
+	var page struct {
+		Count   int            `json:"overallCount"`
+		Limit   *int           `json:"limit"`
+		Offset  *int           `json:"offset"`
+		Entries []*Transaction `json:"entries"`
+	}
+
+	if err := s.get("transactions", url, &page); err != nil {
+		return nil, fmt.Errorf("fetch transactions of user %d: %w", uid, err)
+	}
+	return page.Entries, nil
+}
+
+// mergeTransactions appends the TXs of more that aren't in txs yet.
+func mergeTransactions(txs, more []*Transaction) []*Transaction {
+	seen := map[int]bool{}
+	for _, tx := range txs {
+		if tx != nil {
+			seen[tx.Id] = true
+		}
+	}
+	for _, tx := range more {
+		if tx != nil && !seen[tx.Id] {
+			seen[tx.Id] = true
+			txs = append(txs, tx)
+		}
+	}
+	return txs
+}
+
+func (s *Strichliste) attribute(tx *Transaction) {
+	for _, pattern := range s.Transfers {
+		if match := pattern.From.FindStringSubmatch(*tx.Comment); match != nil {
+			tx.From = &match[1]
+			if !s.KeepComment {
+				tx.Comment = nil
+			}
+			return
+		}
+
+		if match := pattern.To.FindStringSubmatch(*tx.Comment); match != nil {
+			tx.To = &match[1]
+			if !s.KeepComment {
+				tx.Comment = nil
+			}
+			return
+		}
+	}
+
+	tx.Unattributed = s.TransferHint.MatchString(*tx.Comment)
+}
+
+func (s *Strichliste) fetchUserList() ([]int, error) {
+	url := s.ApiEndpoint + s.PathUserList
+
+	// the entries are users without their TXs, the paging fields are unused
+	// but declared for -strict-json
+	var userList struct {
+		Count   int    `json:"overallCount"`
+		Limit   *int   `json:"limit"`
+		Offset  *int   `json:"offset"`
+		Entries []User `json:"entries"`
+	}
+
+	if err := s.get("userlist", url, &userList); err != nil {
+		return nil, fmt.Errorf("fetch user list: %w", err)
+	}
+
+	ids := []int{}
+	for _, user := range userList.Entries {
+		ids = append(ids, user.Id)
+	}
+	return ids, nil
+}
+
+func every(interval time.Duration, align bool, stop <-chan struct{}, fn func()) {
+	fn()
+
+	// wait for the next multiple of the interval since the zero time, the
+	// ticker started then stays in phase with it
+	if align {
+		timer := time.NewTimer(time.Until(time.Now().Truncate(interval).Add(interval)))
+		select {
+		case <-timer.C:
+			fn()
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// tick starts a background scrape cycle unless the previous one is still
+// running, in which case the tick is skipped.
+func (s *Strichliste) tick() {
+	if !s.running.CompareAndSwap(false, true) {
+		s.Metrics.ScrapeOverlaps.Inc()
+		log.Println("warning: previous scrape cycle still running, skipping")
+		return
+	}
+
+	go func() {
+		defer s.running.Store(false)
+		s.scrape()
+	}()
+}
+
+func (s *Strichliste) gatherLocked(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scrapeOnRequest runs a cycle before each request, unless the previous
+// one started less than -min-interval ago.
+func (s *Strichliste) scrapeOnRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.cycle.Lock()
+		if s.cycles == 0 || time.Since(s.last.Start) >= s.MinInterval {
+			s.scrapeLocked()
+		}
+		s.cycle.Unlock()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sanitizeLabel makes a string fit for a label value.
+func sanitizeLabel(msg string) string {
+	msg = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, msg)
+
+	if runes := []rune(msg); len(runes) > 200 {
+		msg = string(runes[:200])
+	}
+	return msg
+}
+
+type ScrapeResult struct {
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration_seconds"`
+	Users    int       `json:"users"`
+	Scraped  int       `json:"scraped"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (s *Strichliste) serveScrape(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := s.scrape()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Println("error: could not encode scrape result:", err)
+	}
+}
+
+var statusPage = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>strichliste exporter</title></head>
+<body>
+<h1>strichliste exporter</h1>
+<table>
+<tr><td>status</td><td>{{if not .Cycles}}waiting for first cycle{{else if .Last.Failures}}down{{else}}up{{end}}</td></tr>
+<tr><td>last cycle</td><td>{{if .Cycles}}{{.Last.Start.Format "2006-01-02 15:04:05 MST"}} ({{printf "%.3f" .Last.Duration}}s){{end}}</td></tr>
+<tr><td>users tracked</td><td>{{.Last.Users}}, {{.Last.Scraped}} scraped</td></tr>
+<tr><td>cycles</td><td>{{.Cycles}}</td></tr>
+{{if .Last.Error}}<tr><td>last error</td><td>{{.Last.Error}}</td></tr>{{end}}
+</table>
+<p><a href="metrics">metrics</a></p>
+</body>
+</html>
+`))
+
+func (s *Strichliste) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.RLock()
+	data := struct {
+		Last   ScrapeResult
+		Cycles int
+	}{s.last, s.cycles}
+	s.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPage.Execute(w, data); err != nil {
+		log.Println("error: could not render status page:", err)
+	}
+}
+
+// fetched is what a scrape cycle got from upstream for a single user.
+type fetched struct {
+	uid      int
+	user     *User
+	err      error
+	backoff  bool
+	duration time.Duration
+}
+
+func (s *Strichliste) scrape() ScrapeResult {
+	s.cycle.Lock()
+	defer s.cycle.Unlock()
+
+	return s.scrapeLocked()
+}
+
+// scrapeLocked runs a scrape cycle, the caller holds cycle.
+func (s *Strichliste) scrapeLocked() (result ScrapeResult) {
+	result.Start = time.Now()
+
+	// Talk to upstream without holding mu, so gathering isn't blocked
+	// behind slow requests or a Retry-After. Only cycles write the state
+	// read here, and they are serialized by cycle.
+	var system *System
+	var systemErr error
+	if !s.systemMissing {
+		system, systemErr = s.fetchSystem()
+	}
+
+	ids, listErr := s.UserIDs, error(nil)
+	if s.ScrapeAll {
+		ids, listErr = s.fetchUserList()
+	}
+
+	var users []fetched
+	if listErr == nil {
+		for _, uid := range s.ordered(ids) {
+			if backoff, ok := s.Backoffs[uid]; ok && backoff.Skip > 0 {
+				users = append(users, fetched{uid: uid, backoff: true})
+				continue
+			}
+
+			start := time.Now()
+			user, err := s.fetchUser(uid)
+			users = append(users, fetched{uid: uid, user: user, err: err, duration: time.Since(start)})
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	defer func() {
+		result.Duration = time.Since(result.Start).Seconds()
+
+		if s.durationEMA == 0 {
+			s.durationEMA = result.Duration
+		} else {
+			s.durationEMA = s.EmaAlpha*result.Duration + (1-s.EmaAlpha)*s.durationEMA
+		}
+		s.Metrics.ScrapeEMA.Set(s.durationEMA)
+
+		s.cycles++
+		if result.Failures > 0 {
+			s.failures++
+		}
+		s.Metrics.ScrapeRatio.Set(float64(s.failures) / float64(s.cycles))
+
+		if s.ExposeError {
+			s.Metrics.LastError.Reset()
+			s.Metrics.LastError.WithLabelValues(sanitizeLabel(result.Error)).Set(1)
+		}
+
+		if s.CountSeries {
+			s.countSeries()
+		}
+
+		s.last = result
+	}()
+
+	s.Metrics.ScrapeCycles.Inc()
+
+	var reported *System
+	if !s.systemMissing {
+		var statusErr *StatusError
+		switch err := systemErr; {
+		case errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound:
+			log.Println("warning: upstream has no system metrics, not fetching them again")
+			s.systemMissing = true
+			s.Metrics.SystemAvailable.Set(0)
+		case err != nil:
+			s.Metrics.ScrapeFailures.Inc()
+			result.Failures++
+			result.Error = err.Error()
+			log.Println("error:", err)
+		default:
+			s.updateSystemMetrics(system)
+			reported = system
+		}
+	}
+
+	if s.ScrapeAll {
+		if err := listErr; err != nil {
+			s.Metrics.ScrapeFailures.Inc()
+			result.Failures++
+			result.Error = err.Error()
+			log.Println("error:", err)
+			s.Metrics.UserListUp.Set(0)
+			s.requireUsers(0)
+			return
+		}
+		s.UserIDs = ids
+		s.Metrics.UserListUp.Set(1)
+		s.Metrics.UserListSize.Set(float64(len(s.UserIDs)))
+	}
+
+	active, series := 0, 0
+	var scraped []*User
+	names := map[string]map[int]bool{}
+	comments := map[string]bool{}
+
+	// the tx series of all users are rebuilt each cycle
+	s.Metrics.UserDeltas.Reset()
+	s.Metrics.UserDeltasAt.Reset()
+	for _, f := range users {
+		uid, user, err := f.uid, f.user, f.err
+		if f.backoff {
+			s.skipBackoff(uid)
+			continue
+		}
+
+		if err != nil {
+			s.observeUser(uid, f.duration)
+			s.Metrics.ScrapeFailures.Inc()
+			result.Failures++
+			result.Error = err.Error()
+			log.Println("error:", err)
+			if name, ok := s.UserNames[uid]; ok {
+				s.Metrics.UserAge.WithLabelValues(name, strconv.Itoa(uid)).Set(time.Since(s.LastScraped[uid]).Seconds())
+			}
+			s.backOff(uid)
+			continue
+		}
+		s.resetBackoff(uid)
+
+		if names[user.Name] == nil {
+			names[user.Name] = map[int]bool{}
+		}
+		names[user.Name][uid] = true
+
+		series += s.updateMetricsForUser(user)
+		scraped = append(scraped, user)
+
+		if s.CommentProbe {
+			for _, tx := range user.TxRecent {
+				if tx.Comment != nil {
+					comments[sanitizeLabel(*tx.Comment)] = true
+				}
+			}
+		}
+
+		for _, tx := range s.newTransactions(uid, user) {
+			s.inc(s.Metrics.TxNew, tx, 1)
+			s.inc(s.Metrics.TxValueSum, tx, math.Abs(tx.Delta))
+			if tx.From != nil || tx.To != nil {
+				s.inc(s.Metrics.TxTransfers, tx, 1)
+			}
+			if tx.Unattributed {
+				s.inc(s.Metrics.TxUnattributed, tx, 1)
+			}
+			s.inc(s.Metrics.TxCategories.WithLabelValues(s.categorize(tx)), tx, 1)
+			if len(s.TxBuckets) > 0 {
+				s.inc(s.Metrics.TxBuckets.WithLabelValues(user.Name, s.bucket(tx)), tx, 1)
+			}
+		}
+
+		if s.isActive(user) {
+			active++
+		}
+		s.observeUser(uid, f.duration)
+	}
+	s.Metrics.ActiveUsers.Set(float64(active))
+	s.Metrics.TxSeries.Set(float64(series))
+	s.Metrics.Comments.Set(float64(len(comments)))
+	collisions := 0
+	for name, ids := range names {
+		if len(ids) > 1 {
+			collisions += len(ids)
+			log.Printf("warning: %d users share the name %q, their metrics collide\n", len(ids), name)
+		}
+	}
+	s.Metrics.NameCollisions.Set(float64(collisions))
+	s.Metrics.StaleUsers.Set(float64(len(s.UserIDs) - len(scraped)))
+	s.requireUsers(len(scraped))
+	s.updateSummaryMetrics(scraped)
+	s.prune()
+	s.Metrics.TrackedTxIDs.Set(float64(len(s.TxHighWater)))
+	if s.ComputeSystem {
+		computed := s.computeSystem(scraped)
+		if reported != nil {
+			s.Metrics.BalanceDiscrepancy.Set(s.money(float64(reported.Balance - computed.Balance)))
+		}
+	}
+
+	result.Users = len(s.UserIDs)
+	result.Scraped = len(scraped)
+	return result
+}
+
+func (s *Strichliste) observeUser(uid int, duration time.Duration) {
+	var labels []string
+	if s.TimingByUser {
+		// users that never scraped have no name to label by
+		name, ok := s.UserNames[uid]
+		if !ok {
+			return
+		}
+		labels = append(labels, name)
+	}
+	s.Metrics.UserDuration.WithLabelValues(labels...).Observe(duration.Seconds())
+}
+
+// ordered returns the user ids in scrape order. Random order keeps an
+// overrunning cycle from always starving the same users.
+func (s *Strichliste) ordered(ids []int) []int {
+	ids = append([]int(nil), ids...)
+	switch s.ScrapeOrder {
+	case "asc":
+		sort.Ints(ids)
+	case "desc":
+		sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+	case "random":
+		s.rand.Shuffle(len(ids), func(i, j int) {
+			ids[i], ids[j] = ids[j], ids[i]
+		})
+	}
+	return ids
+}
+
+// prune forgets the per-user state of users that are no longer tracked,
+// e.g. because they dropped out of the user list.
+func (s *Strichliste) prune() {
+	tracked := map[int]bool{}
+	for _, uid := range s.UserIDs {
+		tracked[uid] = true
+	}
 
-	var interval_ string
-	flag.StringVar(&interval_, "interval", "5m", "interval for scraping upstream")
-	flag.Parse()
+	for uid := range s.TxHighWater {
+		if !tracked[uid] {
+			delete(s.TxHighWater, uid)
+		}
+	}
+	for uid := range s.UserNames {
+		if !tracked[uid] {
+			delete(s.UserNames, uid)
+			delete(s.LastScraped, uid)
+		}
+	}
+	for uid := range s.PrevBalance {
+		if !tracked[uid] {
+			delete(s.PrevBalance, uid)
+		}
+	}
+	for uid := range s.Backoffs {
+		if !tracked[uid] {
+			delete(s.Backoffs, uid)
+			s.deleteBackoffMetric(uid)
+		}
+	}
+}
 
-	for _, idRaw := range flag.Args() {
-		id, err := strconv.Atoi(idRaw)
-		if err != nil {
-			log.Fatalf("error: %s isn't user id\n", idRaw)
+// countSeries sets exporter_series to the number of series currently
+// exposed. Histograms and summaries count once, without their buckets.
+func (s *Strichliste) countSeries() {
+	families, err := s.registry.Gather()
+	if err != nil {
+		log.Println("error: could not count series:", err)
+		return
+	}
+
+	series := 0
+	for _, family := range families {
+		series += len(family.GetMetric())
+	}
+	s.Metrics.ExporterSeries.Set(float64(series))
+}
+
+func (s *Strichliste) updateSummaryMetrics(scraped []*User) {
+	if len(scraped) > 0 {
+		min, max := float64(scraped[0].Balance), float64(scraped[0].Balance)
+		for _, user := range scraped[1:] {
+			min = math.Min(min, float64(user.Balance))
+			max = math.Max(max, float64(user.Balance))
 		}
-		argUserIds = append(argUserIds, id)
+		s.Metrics.BalanceMin.Set(s.money(min))
+		s.Metrics.BalanceMax.Set(s.money(max))
 	}
 
-	var err error
-	if argInterval, err = time.ParseDuration(interval_); err != nil {
-		log.Fatal(err)
+	inDebt, inCredit, debt, txCount := 0, 0, 0.0, 0
+	for _, user := range scraped {
+		txCount += user.TxCount
+		if user.Balance < 0 {
+			inDebt++
+			debt += float64(user.Balance)
+		} else {
+			inCredit++
+		}
+	}
+	s.Metrics.UsersInDebt.Set(float64(inDebt))
+	s.Metrics.UsersInCredit.Set(float64(inCredit))
+	s.Metrics.TotalDebt.Set(s.money(debt))
+	if len(scraped) > 0 {
+		s.Metrics.AvgTxPerUser.Set(float64(txCount) / float64(len(scraped)))
 	}
 }
 
-type Strichliste struct {
-	Client      http.Client
-	ApiEndpoint string
+// computeSystem derives the system metrics from the users scraped this
+// cycle. They only match upstream's if all users are tracked and scraped.
+// Without upstream system metrics, the regular system gauges are filled in
+// from them too.
+func (s *Strichliste) computeSystem(scraped []*User) *System {
+	system := System{UserCount: len(scraped)}
+	for _, user := range scraped {
+		system.Balance += user.Balance
+	}
+	if len(scraped) > 0 {
+		system.AvgBalance = system.Balance / Money(len(scraped))
+	}
 
-	ScrapeInterval time.Duration
-	ScrapeAll      bool
+	s.Metrics.ComputedBalance.Set(s.money(float64(system.Balance)))
+	s.Metrics.ComputedBalanceAvg.Set(s.money(float64(system.AvgBalance)))
+	s.Metrics.ComputedUserCount.Set(float64(system.UserCount))
 
-	UserIDs []int
-	Metrics struct {
-		ScrapeCycles   prometheus.Counter
-		ScrapeFailures prometheus.Counter
+	if s.systemMissing {
+		s.Metrics.SystemUserCount.Set(float64(system.UserCount))
+		s.Metrics.SystemBalance.Set(s.money(float64(system.Balance)))
+		s.Metrics.SystemBalanceAvg.Set(s.money(float64(system.AvgBalance)))
+	}
+	return &system
+}
 
-		SystemTxCount    prometheus.Gauge
-		SystemUserCount  prometheus.Gauge
-		SystemBalance    prometheus.Gauge
-		SystemBalanceAvg prometheus.Gauge
+// newTransactions returns the TXs of a user that weren't seen in previous
+// cycles. The first cycle for a user only records the high-water mark.
+func (s *Strichliste) newTransactions(uid int, user *User) []*Transaction {
+	last, seen := s.TxHighWater[uid]
 
-		UserTxCount *prometheus.GaugeVec
-		UserBalance *prometheus.GaugeVec
-		UserWeight  *prometheus.GaugeVec
-		UserDays    *prometheus.GaugeVec
-		UserDeltas  *prometheus.GaugeVec
+	max := last
+	txs := []*Transaction{}
+	for _, tx := range user.TxRecent {
+		if tx.Id > max {
+			max = tx.Id
+		}
+		if seen && tx.Id > last {
+			txs = append(txs, tx)
+		}
 	}
+	s.TxHighWater[uid] = max
+	return txs
 }
 
-type Transaction struct {
-	Id      int    `json:"id"`
-	WhenRaw string `json:"createDate"`
-	When    time.Time
-	Delta   float64 `json:"value"`
-	From    *string
-	To      *string
-	Comment *string `json:"comment"`
+func (s *Strichliste) inc(counter prometheus.Counter, tx *Transaction, value float64) {
+	if !s.Exemplars {
+		counter.Add(value)
+		return
+	}
+	counter.(prometheus.ExemplarAdder).AddWithExemplar(value, prometheus.Labels{"tx_id": strconv.Itoa(tx.Id)})
 }
 
-type User struct {
-	Name     string         `json:"name"`
-	Weight   float64        `json:"weightedCountOfPurchases"`
-	Days     int            `json:"activeDays"`
-	Balance  float64        `json:"balance"`
-	TxCount  int            `json:"countOfTransactions"`
-	TxRecent []*Transaction `json:"transactions"`
+func (s *Strichliste) categorize(tx *Transaction) string {
+	if tx.Comment != nil {
+		for _, category := range s.Categories {
+			if category.Pattern.MatchString(*tx.Comment) {
+				return category.Name
+			}
+		}
+	}
+	return "other"
 }
 
-type System struct {
-	TxCount    int     `json:"countTransactions"`
-	AvgBalance float64 `json:"avgBalance"`
-	UserCount  int     `json:"countUsers"`
-	Balance    float64 `json:"overallBalance"`
+// bucket returns the smallest upper bound of -tx-buckets the absolute TX
+// value fits into.
+func (s *Strichliste) bucket(tx *Transaction) string {
+	value := math.Abs(tx.Delta)
+	for _, bound := range s.TxBuckets {
+		if value <= bound {
+			return strconv.FormatFloat(bound, 'f', -1, 64)
+		}
+	}
+	return "+Inf"
 }
 
-func (s *Strichliste) fetchSystem() (*System, error) {
-	url := fmt.Sprintf("%s/metrics", s.ApiEndpoint)
+type Backoff struct {
+	Failures int
+	Skip     int
+}
 
-	resp, err := s.Client.Get(url)
-	if err != nil {
-		return nil, err
+// skipBackoff counts down the cycles a backed off user is skipped for.
+func (s *Strichliste) skipBackoff(uid int) {
+	backoff := s.Backoffs[uid]
+	backoff.Skip--
+	s.setBackoffMetric(uid, backoff.Skip)
+}
+
+// backOff records a failed scrape and, after enough consecutive failures,
+// skips the user for exponentially more cycles.
+func (s *Strichliste) backOff(uid int) {
+	if s.BackoffAfter == 0 {
+		return
 	}
-	defer resp.Body.Close()
 
-	var system System
-	if err := json.NewDecoder(resp.Body).Decode(&system); err != nil {
-		return nil, err
+	backoff, ok := s.Backoffs[uid]
+	if !ok {
+		backoff = &Backoff{}
+		s.Backoffs[uid] = backoff
 	}
-	return &system, nil
+	backoff.Failures++
+
+	if n := backoff.Failures - s.BackoffAfter; n >= 0 {
+		backoff.Skip = s.BackoffMax
+		if n < 31 && 1<<n < s.BackoffMax {
+			backoff.Skip = 1 << n
+		}
+		log.Printf("warning: user %d failed %d times in a row, skipping %d cycles\n", uid, backoff.Failures, backoff.Skip)
+	}
+	s.setBackoffMetric(uid, backoff.Skip)
 }
 
-func parseStrichlisteTime(raw string) (*time.Time, error) {
-	t, err := time.Parse("2006-01-02 15:04:05", raw)
-	if err != nil {
-		return nil, err
+func (s *Strichliste) resetBackoff(uid int) {
+	if _, ok := s.Backoffs[uid]; ok {
+		delete(s.Backoffs, uid)
+		s.deleteBackoffMetric(uid)
 	}
-	return &t, nil
 }
 
-func (s *Strichliste) fetchUser(uid int) (*User, error) {
-	url := fmt.Sprintf("%s/user/%d", s.ApiEndpoint, uid)
+func (s *Strichliste) setBackoffMetric(uid, skip int) {
+	// on-demand cycles are at least -min-interval apart
+	cycle := s.ScrapeInterval
+	if cycle <= 0 {
+		cycle = s.MinInterval
+	}
+	seconds := float64(skip) * cycle.Seconds()
 
-	resp, err := s.Client.Get(url)
-	if err != nil {
-		return nil, err
+	// users that never scraped have no name to label by
+	name, ok := s.UserNames[uid]
+	if !ok {
+		return
 	}
-	defer resp.Body.Close()
+	s.Metrics.UserBackoff.WithLabelValues(name, strconv.Itoa(uid)).Set(seconds)
+}
 
-	fromPattern := regexp.MustCompile("^from (.*)$")
-	toPattern := regexp.MustCompile("^to (.*)$")
+// deleteBackoffMetric drops the backoff series of a user, under whatever
+// name it was created.
+func (s *Strichliste) deleteBackoffMetric(uid int) {
+	s.Metrics.UserBackoff.DeletePartialMatch(prometheus.Labels{"id": strconv.Itoa(uid)})
+}
 
-	var user User
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return nil, err
+// requireUsers exits if the first cycle resolved no users.
+func (s *Strichliste) requireUsers(resolved int) {
+	if !s.RequireUsers {
+		return
 	}
+	if resolved == 0 {
+		log.Fatalln("error: first scrape cycle resolved no users")
+	}
+	s.RequireUsers = false
+}
 
+func (s *Strichliste) isActive(user *User) bool {
 	for _, tx := range user.TxRecent {
-		t, err := parseStrichlisteTime(tx.WhenRaw)
-		if err != nil {
-			return nil, err
-		}
-		tx.When = *t
-
-		if tx.Comment != nil {
-			if fromPattern.MatchString(*tx.Comment) {
-				tx.From = &fromPattern.FindStringSubmatch(*tx.Comment)[1]
-				tx.Comment = nil
-				continue
-			}
-
-			if toPattern.MatchString(*tx.Comment) {
-				tx.To = &toPattern.FindStringSubmatch(*tx.Comment)[1]
-				tx.Comment = nil
-				continue
-			}
+		if tx.When.Add(s.Window).After(time.Now()) {
+			return true
 		}
 	}
+	return false
+}
 
-	return &user, nil
+func mkCounter(name, help string, labels ...string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace:   "strichliste",
+		Name:        name,
+		Help:        help,
+		ConstLabels: argLabels,
+	})
 }
 
-func (s *Strichliste) fetchUserList() ([]int, error) {
-	url := fmt.Sprintf("%s/user", s.ApiEndpoint)
+func mkCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "strichliste",
+		Name:        name,
+		Help:        help,
+		ConstLabels: argLabels,
+	}, labels)
+}
 
-	resp, err := s.Client.Get(url)
-	if err != nil {
-		return nil, err
+func mkHistogramVec(name, help string, buckets []float64, labels ...string) *prometheus.HistogramVec {
+	opts := prometheus.HistogramOpts{
+		Namespace:   "strichliste",
+		Name:        name,
+		Help:        help,
+		Buckets:     buckets,
+		ConstLabels: argLabels,
 	}
-	defer resp.Body.Close()
-
-	var userList struct {
-		Entries []struct {
-			Id int `json:"id"`
-		} `json:"entries"`
+	if argNative {
+		// the classic buckets stay for scrapers without native histograms
+		opts.NativeHistogramBucketFactor = 1.1
+		opts.NativeHistogramMaxBucketNumber = 100
+		opts.NativeHistogramMinResetDuration = time.Hour
 	}
+	return prometheus.NewHistogramVec(opts, labels)
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&userList); err != nil {
-		return nil, err
-	}
+func mkGauge(name, help string) prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace:   "strichliste",
+		Name:        name,
+		Help:        help,
+		ConstLabels: argLabels,
+	})
+}
 
-	ids := []int{}
-	for _, user := range userList.Entries {
-		ids = append(ids, user.Id)
-	}
-	return ids, nil
+func mkGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "strichliste",
+		Name:        name,
+		Help:        help,
+		ConstLabels: argLabels,
+	}, labels)
 }
 
-func every(interval time.Duration, fn func()) {
-	ticker := time.NewTicker(interval)
-	fn()
-	for {
-		select {
-		case <-ticker.C:
-			fn()
-		}
-	}
+// TimestampedGaugeVec is a minimal GaugeVec whose samples carry an explicit
+// timestamp, which the client library's GaugeVec can't attach.
+type TimestampedGaugeVec struct {
+	desc    *prometheus.Desc
+	samples map[string]timestampedSample
 }
 
-func (s *Strichliste) scrape() {
-	s.Metrics.ScrapeCycles.Inc()
+type timestampedSample struct {
+	value  float64
+	when   time.Time
+	labels []string
+}
 
-	metrics, err := s.fetchSystem()
-	if err != nil {
-		s.Metrics.ScrapeFailures.Inc()
-		log.Println("error: could not fetch system metrics:", err)
-	} else {
-		s.updateSystemMetrics(metrics)
+func mkTimestampedGaugeVec(name, help string, labels ...string) *TimestampedGaugeVec {
+	return &TimestampedGaugeVec{
+		desc:    prometheus.NewDesc(prometheus.BuildFQName("strichliste", "", name), help, labels, argLabels),
+		samples: map[string]timestampedSample{},
 	}
+}
 
-	if s.ScrapeAll {
-		var err error
-		if s.UserIDs, err = s.fetchUserList(); err != nil {
-			s.Metrics.ScrapeFailures.Inc()
-			log.Println("error: could not fetch user list:", err)
-			return
-		}
-	}
+func (v *TimestampedGaugeVec) Set(value float64, when time.Time, labels ...string) {
+	v.samples[strings.Join(labels, "\xff")] = timestampedSample{value: value, when: when, labels: labels}
+}
 
-	for _, uid := range s.UserIDs {
-		user, err := s.fetchUser(uid)
+func (v *TimestampedGaugeVec) Reset() {
+	v.samples = map[string]timestampedSample{}
+}
+
+func (v *TimestampedGaugeVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *TimestampedGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	for _, sample := range v.samples {
+		metric, err := prometheus.NewConstMetric(v.desc, prometheus.GaugeValue, sample.value, sample.labels...)
 		if err != nil {
-			s.Metrics.ScrapeFailures.Inc()
-			log.Println("error: could not fetch user:", uid, err)
+			ch <- prometheus.NewInvalidMetric(v.desc, err)
 			continue
 		}
-		s.updateMetricsForUser(user)
+		ch <- prometheus.NewMetricWithTimestamp(sample.when, metric)
 	}
 }
 
-func mkCounter(name, help string, labels ...string) prometheus.Counter {
-	return prometheus.NewCounter(prometheus.CounterOpts{
-		Namespace: "strichliste",
-		Name:      name,
-		Help:      help,
-	})
+func balanceLabels() prometheus.Labels {
+	if argCurrency == "" {
+		return argLabels
+	}
+
+	labels := prometheus.Labels{"currency": argCurrency}
+	for name, value := range argLabels {
+		labels[name] = value
+	}
+	return labels
 }
 
-func mkGauge(name, help string) prometheus.Gauge {
+func mkBalanceGauge(name, help string) prometheus.Gauge {
 	return prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace: "strichliste",
-		Name:      name,
-		Help:      help,
+		Namespace:   "strichliste",
+		Name:        name,
+		Help:        help,
+		ConstLabels: balanceLabels(),
 	})
 }
 
-func mkGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+func mkBalanceGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
 	return prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Namespace: "strichliste",
-		Name:      name,
-		Help:      help,
+		Namespace:   "strichliste",
+		Name:        name,
+		Help:        help,
+		ConstLabels: balanceLabels(),
 	}, labels)
 }
 
+func (s *Strichliste) money(value float64) float64 {
+	if !s.RoundBalances {
+		return value
+	}
+	return math.Round(value*100) / 100
+}
+
 func (s *Strichliste) updateSystemMetrics(system *System) {
 	s.Metrics.SystemTxCount.Set(float64(system.TxCount))
 	s.Metrics.SystemUserCount.Set(float64(system.UserCount))
-	s.Metrics.SystemBalance.Set(system.Balance)
-	s.Metrics.SystemBalanceAvg.Set(system.AvgBalance)
+	s.Metrics.SystemBalance.Set(s.money(float64(system.Balance)))
+	s.Metrics.SystemBalanceAvg.Set(s.money(float64(system.AvgBalance)))
 }
 
-func (s *Strichliste) updateMetricsForUser(user *User) {
+func (s *Strichliste) updateMetricsForUser(user *User) int {
 	s.Metrics.UserTxCount.WithLabelValues(user.Name).Set(float64(user.TxCount))
-	s.Metrics.UserBalance.WithLabelValues(user.Name).Set(user.Balance)
+	s.Metrics.UserBalance.WithLabelValues(user.Name).Set(s.money(float64(user.Balance)))
+	if s.LowBalance != nil {
+		below := 0.0
+		if float64(user.Balance) < *s.LowBalance {
+			below = 1
+		}
+		s.Metrics.UserLowBalance.WithLabelValues(user.Name).Set(below)
+	}
 	s.Metrics.UserWeight.WithLabelValues(user.Name).Set(user.Weight)
 	s.Metrics.UserDays.WithLabelValues(user.Name).Set(float64(user.Days))
 
-	s.Metrics.UserDeltas.Reset()
+	active := 1.0
+	if user.Active != nil && !*user.Active {
+		active = 0
+	}
+	s.Metrics.UserActive.WithLabelValues(user.Name).Set(active)
+
+	txRate := 0.0
+	if user.Days > 0 {
+		txRate = float64(user.TxCount) / float64(user.Days)
+	}
+	s.Metrics.UserTxRate.WithLabelValues(user.Name).Set(txRate)
+	s.Metrics.UserTxParsed.WithLabelValues(user.Name).Set(float64(len(user.TxRecent)))
+	s.Metrics.UserParseErrors.WithLabelValues(user.Name).Set(float64(user.TxParseErrors))
+
+	// The API doesn't report when a user was created, so the oldest TX
+	// returned stands in for it. This overestimates the ratio for users
+	// whose TX list is capped.
+	if len(user.TxRecent) > 0 {
+		oldest := user.TxRecent[0].When
+		for _, tx := range user.TxRecent[1:] {
+			if tx.When.Before(oldest) {
+				oldest = tx.When
+			}
+		}
+		days := math.Max(1, math.Ceil(time.Since(oldest).Hours()/24))
+		s.Metrics.UserActivity.WithLabelValues(user.Name).Set(float64(user.Days) / days)
+	}
+
+	balanceDelta := 0.0
+	if prev, ok := s.PrevBalance[user.Id]; ok {
+		balanceDelta = float64(user.Balance) - prev
+	}
+	s.PrevBalance[user.Id] = float64(user.Balance)
+	s.Metrics.UserBalanceDelta.WithLabelValues(user.Name).Set(s.money(balanceDelta))
+
+	s.UserNames[user.Id] = user.Name
+	s.LastScraped[user.Id] = time.Now()
+	s.Metrics.UserAge.WithLabelValues(user.Name, strconv.Itoa(user.Id)).Set(0)
+
+	series, recent, positive, negative, maxValue := 0, 0, 0, 0, 0.0
 	for _, tx := range user.TxRecent {
-		if tx.When.Add(s.ScrapeInterval).After(time.Now()) {
+		if math.Abs(tx.Delta) < s.TxMinAbs {
+			continue
+		}
+
+		// TXs within the window count by sign and value, older ones become
+		// tx series
+		if tx.When.Add(s.Window).After(time.Now()) {
+			recent++
+			maxValue = math.Max(maxValue, math.Abs(tx.Delta))
+			if tx.Delta > 0 {
+				positive++
+			} else if tx.Delta < 0 {
+				negative++
+			}
 			continue
 		}
 
@@ -283,64 +2119,379 @@ func (s *Strichliste) updateMetricsForUser(user *User) {
 			to = *tx.To
 		}
 
-		s.Metrics.UserDeltas.WithLabelValues(
-			user.Name,
-			strconv.Itoa(tx.Id),
-			from,
-			to,
-		).Set(tx.Delta)
+		labels := []string{user.Name, strconv.Itoa(tx.Id)}
+		if !s.OmitParties {
+			labels = append(labels, from, to)
+		}
+		if s.TxTimestamps {
+			s.Metrics.UserDeltasAt.Set(tx.Delta, tx.When, labels...)
+		} else {
+			s.Metrics.UserDeltas.WithLabelValues(labels...).Set(tx.Delta)
+		}
+		series++
+	}
+	if series > 0 || s.ZeroFill {
+		s.Metrics.UserRecentTx.WithLabelValues(user.Name).Set(float64(series))
+	} else {
+		s.Metrics.UserRecentTx.DeleteLabelValues(user.Name)
+	}
+	if recent > 0 {
+		s.Metrics.UserMaxTx.WithLabelValues(user.Name).Set(s.money(maxValue))
+	} else {
+		s.Metrics.UserMaxTx.DeleteLabelValues(user.Name)
 	}
+
+	s.Metrics.UserTxSign.WithLabelValues(user.Name, "positive").Set(float64(positive))
+	s.Metrics.UserTxSign.WithLabelValues(user.Name, "negative").Set(float64(negative))
+
+	return series
 }
 
-func (s *Strichliste) initMetrics(registry *prometheus.Registry) {
+// initMetrics creates the collectors and registers them, returning all
+// registration errors, e.g. for label names that clash.
+func (s *Strichliste) initMetrics(registry prometheus.Registerer) error {
+	var errs []error
+	register := func(collector prometheus.Collector) {
+		if err := registry.Register(collector); err != nil {
+			errs = append(errs, err)
+		}
+	}
 
 	s.Metrics.ScrapeCycles = mkCounter("scrape_cycles", "number of scrape cycles")
 	s.Metrics.ScrapeFailures = mkCounter("scrape_failures", "number of failed scrape cycles")
+	s.Metrics.ScrapeEMA = mkGauge("scrape_duration_ema_seconds", "moving average of the scrape cycle duration")
+	s.Metrics.ScrapeRatio = mkGauge("scrape_failure_ratio", "ratio of scrape cycles with at least one failure")
+	s.Metrics.LastError = mkGaugeVec("last_scrape_error", "last error of the previous scrape cycle, empty if there was none", "error")
+	s.Metrics.ExporterSeries = mkGauge("exporter_series", "number of series exposed after the last cycle")
+	s.Metrics.ModeInfo = mkGaugeVec("mode_info", "how the exporter scrapes upstream", "mode", "scrape_all")
+	s.Metrics.ScrapeOverlaps = mkCounter("scrape_overlaps_total", "number of scrape cycles skipped because the previous one was still running")
 
 	s.Metrics.SystemTxCount = mkGauge("system_tx_count", "total number of TXs")
 	s.Metrics.SystemUserCount = mkGauge("users", "total user count")
-	s.Metrics.SystemBalance = mkGauge("system_balance", "total system balance")
-	s.Metrics.SystemBalanceAvg = mkGauge("balance_avg", "average user balance")
-	s.Metrics.UserTxCount = mkGaugeVec("tx_count", "total number of user TXs", "user")
-	s.Metrics.UserBalance = mkGaugeVec("balance", "account balance", "user")
-	s.Metrics.UserWeight = mkGaugeVec("weight", "account weight", "user")
-	s.Metrics.UserDays = mkGaugeVec("days", "total number of days with activity", "user")
-	s.Metrics.UserDeltas = mkGaugeVec("tx", "transaction", "user", "id", "from", "to")
-
-	registry.MustRegister(s.Metrics.ScrapeCycles)
-	registry.MustRegister(s.Metrics.ScrapeFailures)
-	registry.MustRegister(s.Metrics.SystemTxCount)
-	registry.MustRegister(s.Metrics.SystemUserCount)
-	registry.MustRegister(s.Metrics.SystemBalance)
-	registry.MustRegister(s.Metrics.SystemBalanceAvg)
-	registry.MustRegister(s.Metrics.UserTxCount)
-	registry.MustRegister(s.Metrics.UserBalance)
-	registry.MustRegister(s.Metrics.UserWeight)
-	registry.MustRegister(s.Metrics.UserDays)
-	registry.MustRegister(s.Metrics.UserDeltas)
-}
+	s.Metrics.SystemBalance = mkBalanceGauge("system_balance", "total system balance")
+	s.Metrics.SystemBalanceAvg = mkBalanceGauge("balance_avg", "average user balance")
+	s.Metrics.SystemAvailable = mkGauge("system_metrics_available", "whether upstream provides system metrics")
+	s.Metrics.BalanceMin = mkBalanceGauge("balance_min", "lowest user balance")
+	s.Metrics.BalanceMax = mkBalanceGauge("balance_max", "highest user balance")
+	s.Metrics.UsersInDebt = mkGauge("users_in_debt", "number of users with negative balance")
+	s.Metrics.UsersInCredit = mkGauge("users_in_credit", "number of users with non-negative balance")
+	s.Metrics.TotalDebt = mkBalanceGauge("total_debt", "sum of negative user balances")
+	s.Metrics.ComputedBalance = mkBalanceGauge("computed_system_balance", "sum of scraped user balances")
+	s.Metrics.ComputedBalanceAvg = mkBalanceGauge("computed_balance_avg", "average scraped user balance")
+	s.Metrics.ComputedUserCount = mkGauge("computed_users", "number of scraped users")
+	s.Metrics.BalanceDiscrepancy = mkBalanceGauge("balance_discrepancy", "system balance reported by upstream minus the computed one")
+	s.Metrics.AvgTxPerUser = mkGauge("avg_tx_per_user", "total number of TXs per scraped user")
+	s.Metrics.ActiveUsers = mkGauge("active_users", "number of users with TXs within -window")
+	s.Metrics.UserTxCount = mkGaugeVec("tx_count", "total number of user TXs", argUserLabel)
+	s.Metrics.UserBalance = mkBalanceGaugeVec("balance", "account balance", argUserLabel)
+	s.Metrics.UserWeight = mkGaugeVec("weight", "account weight", argUserLabel)
+	s.Metrics.UserDays = mkGaugeVec("days", "total number of days with activity", argUserLabel)
+	s.Metrics.UserTxRate = mkGaugeVec("user_tx_per_active_day", "number of user TXs per day with activity", argUserLabel)
+	s.Metrics.UserAge = mkGaugeVec("user_last_scrape_age_seconds", "seconds since the user was last scraped successfully", argUserLabel, "id")
+	s.Metrics.UserBalanceDelta = mkBalanceGaugeVec("user_balance_delta", "change of the account balance since the last cycle", argUserLabel)
+	s.Metrics.UserActivity = mkGaugeVec("user_activity_ratio", "days with activity per day since the oldest returned TX", argUserLabel)
+	s.Metrics.UserParseErrors = mkGaugeVec("user_tx_parse_errors", "number of user TXs that couldn't be parsed", argUserLabel)
+	s.Metrics.UserTxParsed = mkGaugeVec("user_tx_parsed", "number of user TXs returned by the API", argUserLabel)
+	s.Metrics.UserBackoff = mkGaugeVec("user_backoff_seconds", "time the user is skipped for after repeated failures", argUserLabel, "id")
+	s.Metrics.UserRecentTx = mkGaugeVec("user_recent_tx_count", "number of user TXs emitted as tx series", argUserLabel)
+	var durationLabels []string
+	if s.TimingByUser {
+		durationLabels = append(durationLabels, argUserLabel)
+	}
+	s.Metrics.UserDuration = mkHistogramVec("user_scrape_duration_seconds", "time to fetch and process a user", prometheus.DefBuckets, durationLabels...)
+	s.Metrics.UserActive = mkGaugeVec("user_active", "whether the account is active, 1 if upstream doesn't say", argUserLabel)
+	s.Metrics.UserLowBalance = mkGaugeVec("user_below_threshold", "whether the account balance is below -low-balance-threshold", argUserLabel)
+	s.Metrics.UserMaxTx = mkBalanceGaugeVec("user_max_tx_value", "largest absolute value of the user TXs within -window", argUserLabel)
+	s.Metrics.UserTxSign = mkGaugeVec("user_tx_sign", "number of user TXs within -window by sign", argUserLabel, "sign")
+	txLabels := []string{argUserLabel, "id"}
+	if !s.OmitParties {
+		txLabels = append(txLabels, "from", "to")
+	}
+	s.Metrics.UserDeltas = mkGaugeVec("tx", "transaction", txLabels...)
+	s.Metrics.UserDeltasAt = mkTimestampedGaugeVec("tx", "transaction", txLabels...)
+	s.Metrics.TxSeries = mkGauge("tx_series_emitted", "number of TX series emitted in the last cycle")
+	s.Metrics.Comments = mkGauge("distinct_comments", "number of distinct TX comments seen in the last cycle")
+	s.Metrics.NameCollisions = mkGauge("user_name_collisions", "number of users sharing their name with another user")
+	s.Metrics.StaleUsers = mkGauge("stale_users", "number of users that failed to scrape in the last cycle")
+	s.Metrics.HttpInFlight = mkGauge("requests_in_flight", "number of upstream requests in progress")
+	s.Metrics.HttpDecode = mkHistogramVec("decode_duration_seconds", "time spent decoding upstream responses", prometheus.ExponentialBuckets(0.0001, 4, 8), "endpoint")
+	s.Metrics.HttpBytes = mkCounterVec("upstream_bytes_total", "number of upstream response body bytes read", "endpoint")
+	s.Metrics.HttpRequests = mkCounterVec("requests_total", "number of upstream requests, including retries and failed ones", "endpoint")
+	s.Metrics.HttpResponses = mkCounterVec("http_responses_total", "number of upstream responses", "endpoint", "code")
+	s.Metrics.TxNew = mkCounter("new_transactions_total", "number of TXs seen for the first time")
+	s.Metrics.TrackedTxIDs = mkGauge("tracked_tx_ids", "number of users whose highest seen TX id is remembered")
+	s.Metrics.UserListSize = mkGauge("userlist_size", "number of users returned by the user list")
+	s.Metrics.UserListUp = mkGauge("userlist_up", "whether the last user list fetch succeeded")
+	s.Metrics.TxValueSum = mkCounter("tx_value_sum_total", "sum of absolute values of TXs seen for the first time")
+	s.Metrics.TxTransfers = mkCounter("transfers_total", "number of transfer TXs seen for the first time, both sides of a transfer count")
+	s.Metrics.TxUnattributed = mkCounter("tx_unattributed_total", "number of TXs that look like a transfer but matched no pattern")
+	s.Metrics.TxBuckets = mkCounterVec("tx_bucket_total", "number of new user TXs by the upper bound of their absolute value", argUserLabel, "bucket")
+	s.Metrics.TxCategories = mkCounterVec("tx_category_total", "number of TXs per comment category", "category")
 
-func main() {
+	mode := "background"
+	if s.ScrapeInterval <= 0 {
+		mode = "ondemand"
+	}
+	s.Metrics.ModeInfo.WithLabelValues(mode, strconv.FormatBool(s.ScrapeAll)).Set(1)
+	s.Metrics.SystemAvailable.Set(1)
+	for _, category := range s.Categories {
+		s.Metrics.TxCategories.WithLabelValues(category.Name)
+	}
+	s.Metrics.TxCategories.WithLabelValues("other")
+
+	register(s.Metrics.ScrapeCycles)
+	register(s.Metrics.ScrapeFailures)
+	register(s.Metrics.ScrapeOverlaps)
+	register(s.Metrics.ScrapeEMA)
+	register(s.Metrics.ScrapeRatio)
+	register(s.Metrics.ModeInfo)
+	if s.ExposeError {
+		register(s.Metrics.LastError)
+	}
+	if s.CountSeries {
+		register(s.Metrics.ExporterSeries)
+	}
+	register(s.Metrics.SystemTxCount)
+	register(s.Metrics.SystemUserCount)
+	register(s.Metrics.SystemBalance)
+	register(s.Metrics.SystemBalanceAvg)
+	register(s.Metrics.SystemAvailable)
+	register(s.Metrics.BalanceMin)
+	register(s.Metrics.BalanceMax)
+	register(s.Metrics.UsersInDebt)
+	register(s.Metrics.UsersInCredit)
+	register(s.Metrics.TotalDebt)
+	register(s.Metrics.AvgTxPerUser)
+	if s.ComputeSystem {
+		register(s.Metrics.ComputedBalance)
+		register(s.Metrics.ComputedBalanceAvg)
+		register(s.Metrics.ComputedUserCount)
+		register(s.Metrics.BalanceDiscrepancy)
+	}
+	register(s.Metrics.ActiveUsers)
+	register(s.Metrics.UserTxCount)
+	register(s.Metrics.UserBalance)
+	register(s.Metrics.UserWeight)
+	register(s.Metrics.UserDays)
+	register(s.Metrics.UserTxRate)
+	register(s.Metrics.UserAge)
+	register(s.Metrics.UserTxSign)
+	register(s.Metrics.UserTxParsed)
+	register(s.Metrics.UserBalanceDelta)
+	register(s.Metrics.UserActivity)
+	register(s.Metrics.UserParseErrors)
+	register(s.Metrics.UserBackoff)
+	register(s.Metrics.UserRecentTx)
+	register(s.Metrics.UserMaxTx)
+	register(s.Metrics.UserActive)
+	register(s.Metrics.UserDuration)
+	if s.LowBalance != nil {
+		register(s.Metrics.UserLowBalance)
+	}
+	if s.TxTimestamps {
+		register(s.Metrics.UserDeltasAt)
+	} else {
+		register(s.Metrics.UserDeltas)
+	}
+	register(s.Metrics.HttpRequests)
+	register(s.Metrics.HttpResponses)
+	register(s.Metrics.HttpInFlight)
+	register(s.Metrics.HttpDecode)
+	register(s.Metrics.HttpBytes)
+	register(s.Metrics.TxCategories)
+	if len(s.TxBuckets) > 0 {
+		register(s.Metrics.TxBuckets)
+	}
+	register(s.Metrics.TxNew)
+	register(s.Metrics.TxValueSum)
+	register(s.Metrics.TxUnattributed)
+	register(s.Metrics.TxTransfers)
+	register(s.Metrics.TxSeries)
+	if s.CommentProbe {
+		register(s.Metrics.Comments)
+	}
+	register(s.Metrics.NameCollisions)
+	register(s.Metrics.StaleUsers)
+	register(s.Metrics.TrackedTxIDs)
+	if s.ScrapeAll {
+		register(s.Metrics.UserListUp)
+		register(s.Metrics.UserListSize)
+	}
+
+	return errors.Join(errs...)
+}
 
-	s := Strichliste{
+func newStrichliste() *Strichliste {
+	s := &Strichliste{
+		Client:         http.Client{Transport: newTransport(), Timeout: argTimeout},
 		ApiEndpoint:    argEndpoint,
 		ScrapeInterval: argInterval,
+		MinInterval:    argMinInterval,
+		Window:         argWindow,
 		ScrapeAll:      len(argUserIds) == 0,
 		UserIDs:        argUserIds,
+		Categories:     argCategories,
+		Transfers:      argTransferPatterns,
+		KeepComment:    argKeep,
+		TransferHint:   argTransferHint,
+		Trace:          argTrace,
+		RoundBalances:  argRound,
+		MaxBytes:       argMaxBytes,
+		StrictJSON:     argStrict,
+		Token:          argToken,
+		BasicUser:      argBasicUser,
+		BasicPassword:  argBasicPass,
+		RetryAfterMax:  argRetryMax,
+		BackoffAfter:   argBackoff,
+		BackoffMax:     argBackoffMax,
+		Exemplars:      argExemplars,
+		RequireUsers:   argRequire,
+		EmaAlpha:       argEmaAlpha,
+		TxMinAbs:       argTxMinAbs,
+		OmitParties:    argOmit,
+		ZeroFill:       argZeroFill,
+		ExposeError:    argLastError,
+		CountSeries:    argSeries,
+		ComputeSystem:  argCompute,
+		FullTx:         argFullTx,
+		TxTimestamps:   argTxTimes,
+		CommentProbe:   argProbe,
+		Accept:         argAccept,
+		LowBalance:     argLowBalance,
+		ScrapeOrder:    argOrder,
+		TxBuckets:      argTxBuckets,
+		TimingByUser:   argUserTiming,
+		PathSystem:     argPathSystem,
+		PathUserList:   argPathUserList,
+		PathUser:       argPathUser,
+		TimeLayouts:    argLayouts,
+		TxHighWater:    map[int]int{},
+		UserNames:      map[int]string{},
+		LastScraped:    map[int]time.Time{},
+		PrevBalance:    map[int]float64{},
+		Backoffs:       map[int]*Backoff{},
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if argNoRedirect {
+		s.Client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	return s
+}
+
+func main() {
+	flag.Parse()
+	if err := configure(flag.Args()); err != nil {
+		log.Fatalln("error:", err)
+	}
+
+	s := newStrichliste()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if argCheck {
+		if err := s.checkConfig(os.Stdout); err != nil {
+			log.Fatalln("error:", err)
+		}
+		os.Exit(0)
+	}
+
+	if argStateFile != "" {
+		s.loadState(argStateFile)
 	}
 
 	registry := prometheus.NewRegistry()
-	s.initMetrics(registry)
+	s.registry = registry
+	if err := s.initMetrics(registry); err != nil {
+		log.Fatalln("error:", err)
+	}
+
+	handler := s.gatherLocked(metricsHandler(registry))
+
+	if s.ScrapeInterval > 0 {
+		go every(s.ScrapeInterval, argAlign, ctx.Done(), s.tick)
+	} else {
+		handler = s.scrapeOnRequest(handler)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	if argStatus {
+		mux.HandleFunc("/", s.serveStatus)
+	}
+
+	servers := []*http.Server{{Addr: argBind, Handler: mux}}
+
+	admin := mux
+	if argAdminBind != "" {
+		admin = http.NewServeMux()
+		admin.HandleFunc("/debug/pprof/", pprof.Index)
+		admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		admin.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		admin.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		servers = append(servers, &http.Server{Addr: argAdminBind, Handler: admin})
+	}
 
-	go every(s.ScrapeInterval, s.scrape)
+	if argConfig {
+		admin.HandleFunc("/config", s.serveConfig)
+	}
+	if argScrape {
+		admin.HandleFunc("/scrape", s.serveScrape)
+	}
+	if argUsers {
+		admin.HandleFunc("/users", s.serveUsers)
+	}
+
+	serve(ctx, servers...)
+
+	if argStateFile != "" {
+		if err := s.saveState(argStateFile); err != nil {
+			log.Println("error: could not save state:", err)
+		}
+	}
+}
 
-	http.Handle("/metrics", promhttp.HandlerFor(
+func metricsHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(
 		registry,
 		promhttp.HandlerOpts{
 			EnableOpenMetrics: true,
 			Registry:          registry,
 		},
-	))
+	)
+}
+
+func serve(ctx context.Context, servers ...*http.Server) {
+	// ListenAndServe returns as soon as Shutdown starts, wait for in-flight
+	// requests to drain before returning
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Println("error: could not shut down cleanly:", err)
+			}
+		}
+	}()
 
-	log.Fatal(http.ListenAndServe(argBind, nil))
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- server.ListenAndServe()
+		}(server)
+	}
+
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-drained
 }